@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// backpressureMonitor flips a shared throttle flag when a device channel
+// has been full for longer than threshold; readers consult shouldThrottle.
+type backpressureMonitor struct {
+	channels  map[string]chan *appsInstalled
+	threshold time.Duration
+	fullSince map[string]time.Time
+	throttled int32 // atomic bool
+}
+
+func newBackpressureMonitor(channels map[string]chan *appsInstalled, threshold time.Duration) *backpressureMonitor {
+	return &backpressureMonitor{
+		channels:  channels,
+		threshold: threshold,
+		fullSince: map[string]time.Time{},
+	}
+}
+
+// run polls the channels at interval until stop is closed.
+func (m *backpressureMonitor) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.check(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (m *backpressureMonitor) check(now time.Time) {
+	throttle := false
+	for device, ch := range m.channels {
+		if len(ch) < cap(ch) {
+			delete(m.fullSince, device)
+			continue
+		}
+		since, ok := m.fullSince[device]
+		if !ok {
+			m.fullSince[device] = now
+			continue
+		}
+		if now.Sub(since) > m.threshold {
+			throttle = true
+		}
+	}
+
+	if throttle {
+		atomic.StoreInt32(&m.throttled, 1)
+	} else {
+		atomic.StoreInt32(&m.throttled, 0)
+	}
+}
+
+func (m *backpressureMonitor) shouldThrottle() bool {
+	return atomic.LoadInt32(&m.throttled) == 1
+}
@@ -0,0 +1,12 @@
+package main
+
+import "time"
+
+// BatchPolicy controls how writeInMemcached groups items before flushing
+// them to a sink: up to Size items, or whatever has accumulated every
+// Interval, written concurrently across Workers goroutines.
+type BatchPolicy struct {
+	Size     int
+	Interval time.Duration
+	Workers  int
+}
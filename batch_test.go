@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// fakeSink is an in-memory Sink standing in for a real memcached/redis
+// round trip, with a small fixed Set latency.
+type fakeSink struct {
+	mu    sync.Mutex
+	n     int
+	delay time.Duration
+}
+
+func (s *fakeSink) Set(key string, value []byte) error {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	s.n++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *fakeSink) Close() error { return nil }
+
+func benchItems(n int) []*appsInstalled {
+	items := make([]*appsInstalled, n)
+	for i := range items {
+		items[i] = &appsInstalled{DevType: "idfa", DevId: "dev", Apps: []uint32{1, 2, 3}}
+	}
+	return items
+}
+
+// BenchmarkWriteOnePerItem is the pre-batching baseline: one Set call at a
+// time, no concurrency.
+func BenchmarkWriteOnePerItem(b *testing.B) {
+	sink := &fakeSink{delay: time.Millisecond}
+	stats := &fileStats{stats: map[string]int{}}
+	logger := newAppLogger(zapcore.AddSync(io.Discard))
+	items := benchItems(b.N)
+
+	b.ResetTimer()
+	for _, item := range items {
+		writeOne(sink, item, stats, RetryPolicy{MaxRetry: 1}, logger)
+	}
+}
+
+// BenchmarkWriteInMemcachedBatched exercises the batched, worker-pool path
+// writeInMemcached drains a device channel through.
+func BenchmarkWriteInMemcachedBatched(b *testing.B) {
+	sink := &fakeSink{delay: time.Millisecond}
+	stats := &fileStats{stats: map[string]int{}}
+	logger := newAppLogger(zapcore.AddSync(io.Discard))
+	batchPolicy := BatchPolicy{Size: 50, Interval: 50 * time.Millisecond, Workers: 16}
+
+	channel := make(chan *appsInstalled, b.N)
+	for _, item := range benchItems(b.N) {
+		channel <- item
+	}
+	close(channel)
+
+	b.ResetTimer()
+	writeInMemcached("idfa", sink, channel, stats, RetryPolicy{MaxRetry: 1}, batchPolicy, logger)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// journalSuffix is the sidecar file recording how many lines of an input
+// file have been acknowledged, for --resume.
+const journalSuffix = ".progress"
+
+// ackTracker tracks acknowledgements for a single input file. Lines fan
+// out across four device channels and are acked out of order, so it
+// buffers acks in pending and only commits the longest contiguous run.
+type ackTracker struct {
+	sync.Mutex
+	journal   *os.File
+	committed int
+	pending   map[int]bool
+}
+
+// newAckTracker opens the journal for filename, seeded from its last
+// committed offset.
+func newAckTracker(filename string) (*ackTracker, error) {
+	f, err := os.OpenFile(filename+journalSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	committed := 0
+	if _, err := fmt.Fscan(f, &committed); err != nil && !errors.Is(err, io.EOF) {
+		committed = 0
+	}
+	return &ackTracker{
+		journal:   f,
+		committed: committed,
+		pending:   map[int]bool{},
+	}, nil
+}
+
+// offset is the line number to resume from.
+func (t *ackTracker) offset() int {
+	t.Lock()
+	defer t.Unlock()
+	return t.committed
+}
+
+// ack marks lineNum as handled, advances committed past any now-contiguous
+// run, and fsyncs the journal.
+func (t *ackTracker) ack(lineNum int) error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.pending[lineNum] = true
+	for t.pending[t.committed] {
+		delete(t.pending, t.committed)
+		t.committed++
+	}
+
+	if _, err := t.journal.Seek(0, 0); err != nil {
+		return err
+	}
+	if err := t.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(t.journal, t.committed); err != nil {
+		return err
+	}
+	return t.journal.Sync()
+}
+
+// close removes the journal once the input file is fully processed.
+func (t *ackTracker) close() error {
+	t.journal.Close()
+	return os.Remove(t.journal.Name())
+}
+
+// renameTo moves the journal alongside an input file renamed elsewhere
+// (e.g. to a .partial prefix on shutdown).
+func (t *ackTracker) renameTo(newFilename string) error {
+	t.Lock()
+	defer t.Unlock()
+	oldPath := t.journal.Name()
+	newPath := newFilename + journalSuffix
+	if oldPath == newPath {
+		return nil
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	t.journal.Close()
+	f, err := os.OpenFile(newPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	t.journal = f
+	return nil
+}
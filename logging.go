@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// debugSubsystem is a component LOADER_DEBUG can enable independently,
+// e.g. LOADER_DEBUG=parse,sink.
+type debugSubsystem string
+
+const (
+	debugParse debugSubsystem = "parse"
+	debugSink  debugSubsystem = "sink"
+	debugFile  debugSubsystem = "file"
+)
+
+// appLogger is a structured logger with per-subsystem debug logging
+// gated by LOADER_DEBUG.
+type appLogger struct {
+	*zap.SugaredLogger
+	debug map[debugSubsystem]bool
+}
+
+// newAppLogger builds a JSON logger writing to ws.
+func newAppLogger(ws zapcore.WriteSyncer) *appLogger {
+	encoderCfg := zap.NewProductionEncoderConfig()
+	encoderCfg.TimeKey = "ts"
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderCfg), ws, zap.DebugLevel)
+	return &appLogger{
+		SugaredLogger: zap.New(core).Sugar(),
+		debug:         parseLoaderDebug(os.Getenv("LOADER_DEBUG")),
+	}
+}
+
+func parseLoaderDebug(val string) map[debugSubsystem]bool {
+	enabled := map[debugSubsystem]bool{}
+	for _, part := range strings.Split(val, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			enabled[debugSubsystem(part)] = true
+		}
+	}
+	return enabled
+}
+
+// debugf logs msg only if subsystem was named in LOADER_DEBUG.
+func (l *appLogger) debugf(subsystem debugSubsystem, msg string, keysAndValues ...interface{}) {
+	if l.debug[subsystem] {
+		l.Debugw(msg, keysAndValues...)
+	}
+}
@@ -6,26 +6,34 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"github.com/bradfitz/gomemcache/memcache"
+	"go.uber.org/zap/zapcore"
 	"log"
 	"os"
+	"os/signal"
 	"otus_hw15/appsinstalled"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type appsInstalled struct {
-	DevType  string
-	DevId    string
-	Lat      float64
-	Lon      float64
-	Apps     []uint32
-	FileName string
+	DevType    string
+	DevId      string
+	Lat        float64
+	Lon        float64
+	Apps       []uint32
+	FileName   string
+	LineNum    int
+	AckTracker *ackTracker
 }
 
+// fileStats accumulates per-file send-failure counts, read once at
+// end-of-file in readFile. Live observability is covered instead by the
+// memcachedSetsTotal/parseErrorsTotal Prometheus counters; this map itself
+// was intentionally left as an end-of-file summary rather than reworked.
 type fileStats struct {
 	sync.Mutex
 	stats map[string]int
@@ -37,11 +45,11 @@ var ErrParseLine = errors.New("can not parse line")
 func parseLine(line string, filename string) (appsInstalled, error) {
 	lineParts := strings.Split(line, "\t")
 	if len(lineParts) != 5 {
-		return appsInstalled{"", "", 0, 0, []uint32{0}, filename}, ErrParseLine
+		return appsInstalled{"", "", 0, 0, []uint32{0}, filename, 0, nil}, ErrParseLine
 	}
 	// dev_type, dev_id, lat, lon, raw_apps
 	if lineParts[0] == "" || lineParts[1] == "" {
-		return appsInstalled{"", "", 0, 0, []uint32{0}, filename}, ErrParseLine
+		return appsInstalled{"", "", 0, 0, []uint32{0}, filename, 0, nil}, ErrParseLine
 	}
 	strApps := strings.Split(lineParts[4], ",")
 	apps := make([]uint32, len(strApps))
@@ -59,6 +67,8 @@ func parseLine(line string, filename string) (appsInstalled, error) {
 		lon,
 		apps,
 		filename,
+		0,
+		nil,
 	}
 	return appsInst, nil
 }
@@ -66,43 +76,113 @@ func parseLine(line string, filename string) (appsInstalled, error) {
 func readFile(
 	filename string,
 	channels map[string]chan *appsInstalled,
-	wg *sync.WaitGroup,
 	stats *fileStats,
-	logger *log.Logger,
+	logger *appLogger,
+	resume bool,
+	shutdown <-chan struct{},
+	monitor *backpressureMonitor,
 ) {
+	start := time.Now()
+	defer func() {
+		fileProcessingDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	file, err := os.Open(filename)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
-	zr, err := gzip.NewReader(file)
+	compressedReader := &countingReader{r: file}
+	zr, err := gzip.NewReader(compressedReader)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	uncompressedReader := &countingReader{r: zr}
 
 	defer file.Close()
 	defer zr.Close()
+	defer func() {
+		bytesReadTotal.WithLabelValues("compressed").Add(float64(compressedReader.n))
+		bytesReadTotal.WithLabelValues("uncompressed").Add(float64(uncompressedReader.n))
+	}()
+
+	var tracker *ackTracker
+	startLine := 0
+	if resume {
+		tracker, err = newAckTracker(filename)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		startLine = tracker.offset()
+		logger.debugf(debugFile, "resuming file", "file", filename, "from_line", startLine)
+	}
 
 	nSuccess := 0
 	nErrors := 0
-	scanner := bufio.NewScanner(zr)
+	lineNum := 0
+	interrupted := false
+	scanner := bufio.NewScanner(uncompressedReader)
+	for ; lineNum < startLine && scanner.Scan(); lineNum++ {
+		// already acknowledged on a previous run; skip without resending
+	}
+scanLoop:
 	for scanner.Scan() {
+		select {
+		case <-shutdown:
+			logger.Infow("shutdown requested, stopping mid-file", "file", filename, "line", lineNum)
+			interrupted = true
+			break scanLoop
+		default:
+		}
+		if monitor != nil && monitor.shouldThrottle() {
+			time.Sleep(50 * time.Millisecond)
+		}
+
 		text := scanner.Text()
 		apps, err := parseLine(text, filename)
+		apps.LineNum = lineNum
+		apps.AckTracker = tracker
 		if err != nil {
 			nErrors += 1
-			logger.Println(err)
-			continue
+			parseErrorsTotal.Inc()
+			logger.debugf(debugParse, "parse error", "file", filename, "error", err.Error())
+			if tracker != nil {
+				if ackErr := tracker.ack(apps.LineNum); ackErr != nil {
+					logger.Errorw("ack failed", "file", filename, "error", ackErr)
+				}
+			}
 		} else {
-			nSuccess += 1
-			channels[apps.DevType] <- &apps
+			select {
+			case channels[apps.DevType] <- &apps:
+				nSuccess += 1
+				linesParsedTotal.Inc()
+			case <-shutdown:
+				// apps.LineNum was never acked, so it stays unsent and
+				// --resume will replay it on the next run.
+				logger.Infow("shutdown requested, stopping mid-file", "file", filename, "line", lineNum)
+				interrupted = true
+				break scanLoop
+			}
 		}
+		lineNum++
 	}
 	err = scanner.Err()
 	if err != nil {
-		logger.Println("Scanner Error")
+		logger.Errorw("scanner error", "file", filename, "error", err)
+	}
+	if interrupted {
+		dir, fn := filepath.Split(filename)
+		partialPath := fmt.Sprintf("%s.partial.%s", dir, fn)
+		if err := os.Rename(filename, partialPath); err != nil {
+			logger.Errorw("partial rename failed", "file", filename, "error", err)
+		} else if tracker != nil {
+			if err := tracker.renameTo(partialPath); err != nil {
+				logger.Errorw("journal rename failed", "file", filename, "error", err)
+			}
+		}
+		return
 	}
+
 	stats.Lock()
 	nSendingErrors := stats.stats[filename]
 	delete(stats.stats, filename)
@@ -111,87 +191,210 @@ func readFile(
 	nErrors += nSendingErrors
 	nSuccess -= nSendingErrors
 	if nSuccess == 0 {
-		logger.Println("All errors. Failed load")
+		logger.Infow("load finished", "file", filename, "outcome", "failed", "reason", "all errors")
 	} else {
 		errRate := float64(nErrors) / float64(nSuccess)
 		if errRate < NormalErrRate {
-			logger.Printf("Acceptable error rate (%f). Successful load", errRate)
+			logger.Infow("load finished", "file", filename, "outcome", "success", "error_rate", errRate)
 		} else {
-			logger.Printf("High error rate (%f > %f). Failed load", errRate, NormalErrRate)
+			logger.Infow("load finished", "file", filename, "outcome", "failed", "error_rate", errRate, "threshold", NormalErrRate)
+		}
+	}
+
+	if tracker != nil {
+		for tracker.offset() < lineNum {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err := tracker.close(); err != nil {
+			logger.Errorw("failed to remove journal", "file", filename, "error", err)
 		}
 	}
 
 	dir, fn := filepath.Split(filename)
+	fn = strings.TrimPrefix(fn, ".partial.")
 	err = os.Rename(filename, fmt.Sprintf("%s/.%s", dir, fn))
 	if err != nil {
-		logger.Println(err)
+		logger.Errorw("rename failed", "file", filename, "error", err)
+	}
+}
+
+// writeOne sends a single appsInstalled entry to sink, applying the retry
+// policy, recording metrics/stats and acking the checkpoint tracker. It is
+// the unit of work writeInMemcached fans out across a batch.
+func writeOne(
+	sink Sink,
+	val *appsInstalled,
+	stats *fileStats,
+	retryPolicy RetryPolicy,
+	logger *appLogger,
+) {
+	key := fmt.Sprintf("%s:%s", val.DevType, val.DevId)
+	strVal := appsinstalled.UserApps{
+		Apps: val.Apps, Lat: &val.Lat, Lon: &val.Lon,
+	}
+	var err error
+	for i := 0; i < retryPolicy.MaxRetry; i++ {
+		if retryPolicy.injectFailure() {
+			err = fmt.Errorf("injected failure (fail-rate)")
+		} else {
+			err = sink.Set(key, []byte(strVal.String()))
+		}
+		if err == nil {
+			break
+		}
+		memcachedSetsTotal.WithLabelValues(val.DevType, "retry").Inc()
+		logger.debugf(debugSink, "set retry", "device", val.DevType, "file", val.FileName, "error", err.Error())
+		time.Sleep(retryPolicy.delay(i))
+	}
+
+	if err != nil {
+		logger.Errorw("sending failed", "device", val.DevType, "file", val.FileName, "error", err)
+		memcachedSetsTotal.WithLabelValues(val.DevType, "fail").Inc()
+		stats.Lock()
+		stats.stats[val.FileName] += 1
+		stats.Unlock()
+	} else {
+		memcachedSetsTotal.WithLabelValues(val.DevType, "success").Inc()
 	}
+	logger.debugf(debugSink, "set", "device", val.DevType, "dev_id", val.DevId, "value", strVal.String())
 
-	defer wg.Done()
-	return
+	// whether this line ultimately succeeded or exhausted its retries,
+	// it has been fully handled: ack it so the checkpoint can advance
+	// and a resumed run won't resend it.
+	if val.AckTracker != nil {
+		if ackErr := val.AckTracker.ack(val.LineNum); ackErr != nil {
+			logger.Errorw("ack failed", "device", val.DevType, "file", val.FileName, "error", ackErr)
+		}
+	}
 }
 
+// writeInMemcached drains channel into the sink for one device, batching
+// up to batchPolicy.Size items (or flushing every batchPolicy.Interval)
+// and writing each batch concurrently across batchPolicy.Workers
+// goroutines, exploiting the fact that the underlying client multiplexes
+// over a connection pool and is safe for concurrent use.
 func writeInMemcached(
-	memClient *memcache.Client,
+	device string,
+	sink Sink,
 	channel chan *appsInstalled,
 	stats *fileStats,
-	maxRetry int,
-	timeRetry int,
-	logger *log.Logger,
+	retryPolicy RetryPolicy,
+	batchPolicy BatchPolicy,
+	logger *appLogger,
 ) {
-	for val := range channel {
-		key := fmt.Sprintf("%s:%s", val.DevType, val.DevId)
-		strVal := appsinstalled.UserApps{
-			Apps: val.Apps, Lat: &val.Lat, Lon: &val.Lon,
-		}
-		var err error
-		for i := 0; i < maxRetry; i++ {
-			err = memClient.Set(&memcache.Item{Key: key, Value: []byte(strVal.String())})
-			if err == nil {
-				break
-			}
-			time.Sleep(time.Duration(timeRetry) * time.Second)
+	defer sink.Close()
+
+	batch := make([]*appsInstalled, 0, batchPolicy.Size)
+	ticker := time.NewTicker(batchPolicy.Interval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
 		}
+		items := batch
+		batch = make([]*appsInstalled, 0, batchPolicy.Size)
 
-		if err != nil {
-			logger.Printf("sending failed: %s", err)
-			stats.Lock()
-			stats.stats[val.FileName] += 1
-			stats.Unlock()
+		start := time.Now()
+		sem := make(chan struct{}, batchPolicy.Workers)
+		var batchWg sync.WaitGroup
+		for _, item := range items {
+			batchWg.Add(1)
+			sem <- struct{}{}
+			go func(val *appsInstalled) {
+				defer batchWg.Done()
+				defer func() { <-sem }()
+				writeOne(sink, val, stats, retryPolicy, logger)
+			}(item)
+		}
+		batchWg.Wait()
+		batchLatency.WithLabelValues(device).Observe(time.Since(start).Seconds())
+	}
+
+	for {
+		select {
+		case val, ok := <-channel:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, val)
+			if len(batch) >= batchPolicy.Size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
 		}
-		logger.Printf("set %s in %s \n", strVal.String(), val.DevId)
 	}
 }
 
 func main() {
 	channelSize := flag.Int("queue_size", 10, "set channel size")
 	maxRetry := flag.Int("max_retry", 3, "set count retry putting in memcached")
-	timeRetry := flag.Int("time_retry", 1, "set time between retry putting in memcached")
+	errorBackoff := flag.String("error-backoff", "1s,1s", "base,max delay for exponential backoff with jitter between retries (e.g. \"200ms,5s\")")
+	failRate := flag.Float64("fail-rate", 0, "probability (0.0-1.0) of injecting an artificial memcache.Set failure, for testing against unstable instances")
 	pattern := flag.String("pattern", "/home/dmitrii/GolandProjects/otus_hw15/data/appsinstalled/*.tsv.gz", "pattern to glob")
-	idfa := flag.String("idfa", "127.0.0.1:33013", "memchache addr to idfa")
-	gaid := flag.String("gaid", "127.0.0.1:33014", "memchache addr to gaid")
-	adid := flag.String("adid", "127.0.0.1:33015", "memchache addr to adid")
-	dvid := flag.String("dvid", "127.0.0.1:33016", "memchache addr to dvid")
+	idfa := flag.String("idfa", "memcache://127.0.0.1:33013", "sink url for idfa (memcache://, redis://, file://, stdout://)")
+	gaid := flag.String("gaid", "memcache://127.0.0.1:33014", "sink url for gaid (memcache://, redis://, file://, stdout://)")
+	adid := flag.String("adid", "memcache://127.0.0.1:33015", "sink url for adid (memcache://, redis://, file://, stdout://)")
+	dvid := flag.String("dvid", "memcache://127.0.0.1:33016", "sink url for dvid (memcache://, redis://, file://, stdout://)")
 	logName := flag.String("log", "", "name to log file")
 	memTimeout := flag.Int("timeout", 1, "memclient timeout")
+	resume := flag.Bool("resume", false, "maintain a <file>.progress journal and resume from it on restart, instead of reprocessing interrupted files from scratch")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics on (e.g. \":9090\"); disabled if empty")
+	readerConcurrency := flag.Int("reader-concurrency", 4, "number of input files read concurrently")
+	backpressureTimeout := flag.Duration("backpressure-timeout", 5*time.Second, "how long a device channel may stay full before readers are throttled")
+	batchSize := flag.Int("batch-size", 50, "max items accumulated per sink before a batch is flushed")
+	batchInterval := flag.Duration("batch-interval", 200*time.Millisecond, "max time to wait for a batch to fill before flushing it anyway")
+	batchWorkers := flag.Int("batch-workers", 4, "concurrent Set calls per device when flushing a batch")
 
 	flag.Parse()
 
-	var logger log.Logger
+	backoffBase, backoffMax, err := ParseBackoffFlag(*errorBackoff)
+	if err != nil {
+		log.Fatal(err)
+	}
+	retryPolicy := RetryPolicy{
+		MaxRetry:  *maxRetry,
+		BaseDelay: backoffBase,
+		MaxDelay:  backoffMax,
+		FailRate:  *failRate,
+	}
+	batchPolicy := BatchPolicy{
+		Size:     *batchSize,
+		Interval: *batchInterval,
+		Workers:  *batchWorkers,
+	}
+
+	var ws zapcore.WriteSyncer
 	if *logName != "" {
-		f, err := os.OpenFile(*logName, os.O_RDWR|os.O_CREATE, 0666)
+		f, err := os.OpenFile(*logName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer f.Close()
-		logger = *log.New(f, "", log.Ldate|log.Ltime)
+		ws = zapcore.AddSync(f)
 	} else {
-		logger = *log.New(os.Stdout, "", log.Ldate|log.Ltime)
+		ws = zapcore.AddSync(os.Stdout)
 	}
+	logger := newAppLogger(ws)
+	defer logger.Sync()
 
-	var wg sync.WaitGroup
-	log.Println("start")
-	deviceMemc := map[string]string{
+	if *metricsAddr != "" {
+		StartMetricsServer(*metricsAddr)
+	}
+
+	shutdown := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		logger.Infow("shutdown signal received, draining in-flight work", "signal", sig.String())
+		close(shutdown)
+	}()
+
+	logger.Info("start")
+	deviceSinkURL := map[string]string{
 		"idfa": *idfa,
 		"gaid": *gaid,
 		"adid": *adid,
@@ -202,23 +405,78 @@ func main() {
 
 	// заведем 4 канала
 	channels := map[string]chan *appsInstalled{}
-	for device, addr := range deviceMemc {
+	stopDepthWatch := make(chan struct{})
+	var writerWg sync.WaitGroup
+	for device, sinkURL := range deviceSinkURL {
 		channels[device] = make(chan *appsInstalled, *channelSize)
-		mc := memcache.New(addr)
-		mc.Timeout = time.Duration(*memTimeout) * time.Second
-		go writeInMemcached(mc, channels[device], &stats, *maxRetry, *timeRetry, &logger)
+		sink, err := NewSink(sinkURL, time.Duration(*memTimeout)*time.Second)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		writerWg.Add(1)
+		go func(device string, sink Sink, channel chan *appsInstalled) {
+			defer writerWg.Done()
+			writeInMemcached(device, sink, channel, &stats, retryPolicy, batchPolicy, logger)
+		}(device, sink, channels[device])
+		go watchChannelDepth(device, channels[device], time.Second, stopDepthWatch)
 	}
 
+	monitor := newBackpressureMonitor(channels, *backpressureTimeout)
+	go monitor.run(time.Second, stopDepthWatch)
+
 	fileNames, err := filepath.Glob(*pattern)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	if *resume {
+		partialFiles, err := filepath.Glob(filepath.Join(filepath.Dir(*pattern), ".partial.*"))
+		if err != nil {
+			logger.Errorw("failed to glob partial files", "error", err)
+		} else {
+			// *pattern itself can already match ".partial.*" names (unlike a
+			// shell glob, filepath.Match doesn't special-case leading dots),
+			// so drop those from fileNames or they'd be queued twice.
+			deduped := fileNames[:0]
+			for _, fn := range fileNames {
+				if !strings.HasPrefix(filepath.Base(fn), ".partial.") {
+					deduped = append(deduped, fn)
+				}
+			}
+			fileNames = append(partialFiles, deduped...)
+		}
+	}
 
+	fileQueue := make(chan string, len(fileNames))
 	for _, fn := range fileNames {
-		logger.Println("start read file")
-		wg.Add(1)
-		go readFile(fn, channels, &wg, &stats, &logger)
+		fileQueue <- fn
 	}
+	close(fileQueue)
 
-	wg.Wait()
+	var readerWg sync.WaitGroup
+	for i := 0; i < *readerConcurrency; i++ {
+		readerWg.Add(1)
+		go func() {
+			defer readerWg.Done()
+			for {
+				select {
+				case fn, ok := <-fileQueue:
+					if !ok {
+						return
+					}
+					logger.Infow("start read file", "file", fn)
+					readFile(fn, channels, &stats, logger, *resume, shutdown, monitor)
+				case <-shutdown:
+					return
+				}
+			}
+		}()
+	}
+	readerWg.Wait()
+
+	for _, channel := range channels {
+		close(channel)
+	}
+	writerWg.Wait()
+	close(stopDepthWatch)
+	logger.Info("stop")
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	linesParsedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "loader_lines_parsed_total",
+		Help: "Total number of input lines successfully parsed.",
+	})
+
+	parseErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "loader_parse_errors_total",
+		Help: "Total number of input lines that failed to parse.",
+	})
+
+	memcachedSetsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "loader_sink_sets_total",
+		Help: "Sink Set() attempts by device type and outcome (success, retry, fail).",
+	}, []string{"device", "outcome"})
+
+	channelDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "loader_channel_depth",
+		Help: "Current number of buffered items in-flight per device channel.",
+	}, []string{"device"})
+
+	// Not labeled by file: with a glob matching thousands of files that
+	// would be an unbounded number of permanent series.
+	fileProcessingDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "loader_file_processing_duration_seconds",
+		Help:    "Time to fully read and dispatch one input file.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	batchLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "loader_batch_latency_seconds",
+		Help:    "Time to write one batch of items to a sink, by device type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"device"})
+
+	bytesReadTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "loader_bytes_read_total",
+		Help: "Bytes read from input files, by compressed vs uncompressed.",
+	}, []string{"kind"})
+)
+
+// StartMetricsServer serves the Prometheus registry at addr.
+func StartMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("metrics server stopped: %s", err)
+		}
+	}()
+}
+
+// watchChannelDepth periodically publishes len(channel) as a gauge.
+func watchChannelDepth(device string, channel chan *appsInstalled, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			channelDepth.WithLabelValues(device).Set(float64(len(channel)))
+		case <-stop:
+			return
+		}
+	}
+}
+
+// countingReader wraps a reader and counts bytes passed through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
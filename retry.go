@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// RetryPolicy controls the backoff between writeInMemcached's retries and,
+// for testing, an artificial failure rate applied before the real Set call.
+type RetryPolicy struct {
+	MaxRetry  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	FailRate  float64
+}
+
+// ParseBackoffFlag parses --error-backoff in "base,max" form, e.g. "200ms,5s".
+func ParseBackoffFlag(val string) (base, max time.Duration, err error) {
+	parts := strings.Split(val, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("error-backoff must be \"base,max\" (e.g. \"200ms,5s\"), got %q", val)
+	}
+	base, err = time.ParseDuration(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error-backoff base: %w", err)
+	}
+	max, err = time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error-backoff max: %w", err)
+	}
+	return base, max, nil
+}
+
+// delay is base * 2^attempt capped at MaxDelay, with jitter so goroutines
+// retrying in lockstep don't all hammer memcached at once.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay << attempt
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	jitter := time.Duration(rand.Float64()*float64(d)) - d/2
+	d += jitter
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// injectFailure pseudo-randomly reports a failure according to FailRate.
+func (p RetryPolicy) injectFailure() bool {
+	return p.FailRate > 0 && rand.Float64() < p.FailRate
+}
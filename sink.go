@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/go-redis/redis/v8"
+)
+
+// Sink is the write target for a device's key/value pairs: memcached,
+// Redis, a file, or stdout.
+type Sink interface {
+	Set(key string, value []byte) error
+	Close() error
+}
+
+// NewSink builds a Sink from a URL, e.g. "memcache://host:port",
+// "redis://host:port", "file:///path/to/out.tsv" or "stdout://". A bare
+// "host:port" with no "://" is accepted as shorthand for memcache://,
+// keeping old-style device addresses working (url.Parse chokes on a bare
+// "host:port" and misparses "host:port" without dots as scheme:opaque).
+func NewSink(rawURL string, memTimeout time.Duration) (Sink, error) {
+	if !strings.Contains(rawURL, "://") {
+		mc := memcache.New(rawURL)
+		mc.Timeout = memTimeout
+		return &memcacheSink{client: mc}, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink url %q: %w", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "memcache":
+		mc := memcache.New(u.Host)
+		mc.Timeout = memTimeout
+		return &memcacheSink{client: mc}, nil
+	case "redis":
+		rc := redis.NewClient(&redis.Options{Addr: u.Host})
+		return &redisSink{client: rc}, nil
+	case "file":
+		path := u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &fileSink{f: f, w: bufio.NewWriter(f)}, nil
+	case "stdout":
+		return &stdoutSink{}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink scheme %q in %q", u.Scheme, rawURL)
+	}
+}
+
+type memcacheSink struct {
+	client *memcache.Client
+}
+
+func (s *memcacheSink) Set(key string, value []byte) error {
+	return s.client.Set(&memcache.Item{Key: key, Value: value})
+}
+
+func (s *memcacheSink) Close() error { return nil }
+
+type redisSink struct {
+	client *redis.Client
+}
+
+func (s *redisSink) Set(key string, value []byte) error {
+	return s.client.Set(context.Background(), key, value, 0).Err()
+}
+
+func (s *redisSink) Close() error { return s.client.Close() }
+
+// fileSink writes newline-delimited, base64-encoded records for offline
+// debugging and replay (raw values may contain newlines themselves).
+type fileSink struct {
+	sync.Mutex
+	f *os.File
+	w *bufio.Writer
+}
+
+func (s *fileSink) Set(key string, value []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, err := fmt.Fprintf(s.w, "%s\t%s\n", key, base64.StdEncoding.EncodeToString(value)); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+func (s *fileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	return s.f.Close()
+}
+
+// stdoutSink is a no-op sink for dry runs, printing a summary per write.
+type stdoutSink struct{}
+
+func (s *stdoutSink) Set(key string, value []byte) error {
+	fmt.Printf("%s\t%d bytes\n", key, len(value))
+	return nil
+}
+
+func (s *stdoutSink) Close() error { return nil }